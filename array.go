@@ -0,0 +1,369 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+)
+
+// arrayFlags holds the decoded contents of the Array Flags subelement.
+type arrayFlags struct {
+	class                          ArrayClass
+	isComplex, isGlobal, isLogical bool
+	nzmax                          uint32
+}
+
+// decodeArray decodes structured array data: the Array Flags, Dimensions
+// Array and Array Name subelements common to every class, followed by the
+// class-specific subelements.
+func decodeArray(de dataElement, bo binary.ByteOrder, streaming bool) (interface{}, error) {
+	sub := elementStream{bo, de.r, 0, streaming}
+
+	flags, err := decodeArrayFlags(&sub, bo)
+	if err != nil {
+		return nil, err
+	}
+	dims, err := decodeDimensions(&sub, bo)
+	if err != nil {
+		return nil, err
+	}
+	name, err := decodeName(&sub, bo)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Var{}
+	v.ArrayClass = flags.class
+	v.IsComplex = flags.isComplex
+	v.IsGlobal = flags.isGlobal
+	v.IsLogical = flags.isLogical
+	v.Nzmax = flags.nzmax
+	v.Dimensions = dims
+	v.Name = name
+
+	switch v.ArrayClass {
+	case ClassCell:
+		err = decodeCell(v, &sub, bo)
+	case ClassStruct:
+		err = decodeStruct(v, &sub, bo)
+	case ClassObject:
+		err = decodeObject(v, &sub, bo)
+	case ClassChar:
+		err = decodeChar(v, &sub, bo)
+	case ClassSparse:
+		err = decodeSparse(v, &sub, bo)
+	default:
+		err = decodeNumericArray(v, &sub, bo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// decodeArrayFlags reads the Array Flags subelement: a miUINT32 element
+// whose first word packs the class in its low byte and the
+// complex/global/logical flags in the next byte, and whose second word
+// is nzmax (used only for sparse arrays).
+func decodeArrayFlags(sub *elementStream, bo binary.ByteOrder) (arrayFlags, error) {
+	var flags arrayFlags
+	de, err := sub.nextElement()
+	if err != nil {
+		return flags, err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return flags, err
+	}
+	words, ok := raw.([]uint32)
+	if !ok || len(words) != 2 {
+		return flags, errors.New("matfile: malformed array flags subelement")
+	}
+	flags.class = ArrayClass(words[0] & 0xff)
+	flagByte := (words[0] >> 8) & 0xff
+	flags.isComplex = flagByte&0x08 != 0
+	flags.isGlobal = flagByte&0x04 != 0
+	flags.isLogical = flagByte&0x02 != 0
+	flags.nzmax = words[1]
+	return flags, nil
+}
+
+// decodeDimensions reads the Dimensions Array subelement.
+func decodeDimensions(sub *elementStream, bo binary.ByteOrder) ([]int32, error) {
+	de, err := sub.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return nil, err
+	}
+	dims, ok := raw.([]int32)
+	if !ok {
+		return nil, errors.New("matfile: malformed dimensions array subelement")
+	}
+	return dims, nil
+}
+
+// decodeName reads the Array Name subelement, which is stored as miINT8.
+func decodeName(sub *elementStream, bo binary.ByteOrder) (string, error) {
+	de, err := sub.nextElement()
+	if err != nil {
+		return "", err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return "", err
+	}
+	return int8sToString(raw)
+}
+
+// int8sToString converts the result of decodeNumeric for an miINT8
+// element into a string.
+func int8sToString(raw interface{}) (string, error) {
+	vals, ok := raw.([]int8)
+	if !ok {
+		return "", errors.New("matfile: expected miINT8 data")
+	}
+	b := make([]byte, len(vals))
+	for i, c := range vals {
+		b[i] = byte(c)
+	}
+	return string(b), nil
+}
+
+// numElements returns the number of elements implied by a Dimensions Array.
+// It rejects negative dimensions and overflow, which would otherwise let a
+// malformed file drive make([]*Var, n) into a panic.
+func numElements(dims []int32) (int, error) {
+	n := 1
+	for _, d := range dims {
+		if d < 0 {
+			return 0, errors.New("matfile: negative dimension in Dimensions Array")
+		}
+		if d != 0 && n > (1<<31)/int(d) {
+			return 0, errors.New("matfile: Dimensions Array overflows element count")
+		}
+		n *= int(d)
+	}
+	return n, nil
+}
+
+// decodeNumericArray reads the real part, and the imaginary part if present,
+// of a numeric-class array.
+func decodeNumericArray(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	pr, err := sub.nextElement()
+	if err != nil {
+		return err
+	}
+	v.RealPart, err = decodeElement(pr, bo, sub.Streaming)
+	if err != nil {
+		return err
+	}
+	if v.IsComplex {
+		pi, err := sub.nextElement()
+		if err != nil {
+			return err
+		}
+		v.ImagPart, err = decodeElement(pi, bo, sub.Streaming)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSparse reads the row-index (ir), column-index (jc), and data
+// subelements of a sparse array.
+func decodeSparse(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	irElt, err := sub.nextElement()
+	if err != nil {
+		return err
+	}
+	ir, err := decodeElement(irElt, bo, sub.Streaming)
+	if err != nil {
+		return err
+	}
+	rowIndex, ok := ir.([]int32)
+	if !ok {
+		return errors.New("matfile: malformed sparse row-index subelement")
+	}
+	v.RowIndex = rowIndex
+
+	jcElt, err := sub.nextElement()
+	if err != nil {
+		return err
+	}
+	jc, err := decodeElement(jcElt, bo, sub.Streaming)
+	if err != nil {
+		return err
+	}
+	colIndex, ok := jc.([]int32)
+	if !ok {
+		return errors.New("matfile: malformed sparse column-index subelement")
+	}
+	v.ColIndex = colIndex
+
+	return decodeNumericArray(v, sub, bo)
+}
+
+// decodeChar reads the character data subelement of a char array. MATLAB
+// may encode it as miUTF8/miUTF16/miUTF32 (already decoded to a string by
+// decodeNumeric) or as raw miUINT16 code units.
+func decodeChar(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	de, err := sub.nextElement()
+	if err != nil {
+		return err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return err
+	}
+	switch data := raw.(type) {
+	case string:
+		v.RealPart = data
+	case []uint16:
+		v.RealPart = string(utf16.Decode(data))
+	default:
+		return errors.New("matfile: unsupported character data subelement")
+	}
+	return nil
+}
+
+// decodeCell reads the recursive Var subelements of a cell array, one per
+// element implied by the Dimensions Array.
+func decodeCell(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	n, err := numElements(v.Dimensions)
+	if err != nil {
+		return err
+	}
+	v.Cells = make([]*Var, n)
+	for i := 0; i < n; i++ {
+		cv, err := decodeMatrixSubelement(sub, bo)
+		if err != nil {
+			return err
+		}
+		v.Cells[i] = cv
+	}
+	return nil
+}
+
+// decodeStruct reads the FieldNameLength, FieldNames, and per-field Var
+// subelements of a struct array.
+func decodeStruct(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	fieldNameLength, err := decodeFieldNameLength(sub, bo)
+	if err != nil {
+		return err
+	}
+	v.FieldNameLength = fieldNameLength
+
+	fieldNames, err := decodeFieldNames(sub, bo)
+	if err != nil {
+		return err
+	}
+	v.FieldNames = fieldNames
+
+	return decodeFields(v, sub, bo)
+}
+
+// decodeObject reads the ClassName subelement and then decodes the same
+// FieldNameLength / FieldNames / per-field Var subelements as a struct.
+func decodeObject(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	de, err := sub.nextElement()
+	if err != nil {
+		return err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return err
+	}
+	className, ok := raw.([]int8)
+	if !ok {
+		return errors.New("matfile: malformed class name subelement")
+	}
+	v.ClassName = className
+
+	return decodeStruct(v, sub, bo)
+}
+
+func decodeFieldNameLength(sub *elementStream, bo binary.ByteOrder) (int32, error) {
+	de, err := sub.nextElement()
+	if err != nil {
+		return 0, err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return 0, err
+	}
+	vals, ok := raw.([]int32)
+	if !ok || len(vals) != 1 {
+		return 0, errors.New("matfile: malformed field name length subelement")
+	}
+	if vals[0] < 0 {
+		return 0, errors.New("matfile: negative field name length subelement")
+	}
+	return vals[0], nil
+}
+
+func decodeFieldNames(sub *elementStream, bo binary.ByteOrder) ([]int8, error) {
+	de, err := sub.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return nil, err
+	}
+	names, ok := raw.([]int8)
+	if !ok {
+		return nil, errors.New("matfile: malformed field names subelement")
+	}
+	return names, nil
+}
+
+// decodeFields reads one recursive Var subelement per field, per element,
+// in the order MATLAB writes them: all fields of element 0, then all
+// fields of element 1, and so on.
+func decodeFields(v *Var, sub *elementStream, bo binary.ByteOrder) error {
+	if v.FieldNameLength == 0 {
+		return errors.New("matfile: zero field name length in struct array")
+	}
+	numFields := len(v.FieldNames) / int(v.FieldNameLength)
+	n, err := numElements(v.Dimensions)
+	if err != nil {
+		return err
+	}
+	total := n * numFields
+	v.Cells = make([]*Var, total)
+	for i := 0; i < total; i++ {
+		fv, err := decodeMatrixSubelement(sub, bo)
+		if err != nil {
+			return err
+		}
+		v.Cells[i] = fv
+	}
+	return nil
+}
+
+// decodeMatrixSubelement reads and decodes the next subelement, which is
+// expected to be a (possibly compressed) miMATRIX, as used by cell, struct
+// and object arrays.
+func decodeMatrixSubelement(sub *elementStream, bo binary.ByteOrder) (*Var, error) {
+	de, err := sub.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeElement(de, bo, sub.Streaming)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := raw.(*Var)
+	if !ok {
+		return nil, errors.New("matfile: expected a matrix subelement")
+	}
+	return v, nil
+}
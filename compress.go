@@ -0,0 +1,211 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Compressor constructs a decompressing Reader over a data element's
+// compressed byte stream.
+type Compressor func(io.Reader) (io.ReadCloser, error)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[dataType]Compressor{}
+)
+
+// RegisterCompressor associates a Compressor with the data elements of
+// type id, so that decodeElement can decompress them. matfile registers
+// zlib, the only compression miCOMPRESSED elements use in the MAT-File
+// specification; RegisterCompressor exists so callers can plug in
+// alternate or instrumented decompressors.
+func RegisterCompressor(id dataType, ctor Compressor) {
+	if ctor == nil {
+		panic("matfile: RegisterCompressor called with nil Compressor")
+	}
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[id] = ctor
+}
+
+func compressorFor(id dataType) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	ctor, ok := compressors[id]
+	return ctor, ok
+}
+
+func init() {
+	RegisterCompressor(miCOMPRESSED, func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	})
+}
+
+// decompressElement decompresses a compressed data element and decodes the
+// single data element it contains. It operates on an io.Reader view of
+// the enclosing section, rather than on in.r directly, so a miCOMPRESSED
+// element nested inside another one composes naturally: the outer call's
+// Compressor and the inner call's Compressor each wrap one more layer
+// around the same underlying stream.
+//
+// When streaming is false, the decompressed bytes are read fully into
+// memory first, giving the resulting elementStream random access. When
+// streaming is true, subelements are decoded directly off the
+// decompression stream without buffering, which keeps memory bounded for
+// very large compressed arrays but requires that they be read in order.
+func decompressElement(in dataElement, bo binary.ByteOrder, streaming bool) (dataElement, error) {
+	ctor, ok := compressorFor(in.dataType)
+	if !ok {
+		return dataElement{}, errors.New("matfile: no Compressor registered for this data type")
+	}
+	zr, err := ctor(io.NewSectionReader(in.r, 0, int64(in.nBytes)))
+	if err != nil {
+		return dataElement{}, err
+	}
+
+	if streaming {
+		seq := newSequentialReaderAt(zr)
+		zstream := elementStream{bo, seq, 0, true}
+		de, err := zstream.nextElement()
+		if err != nil {
+			seq.Close()
+			return dataElement{}, err
+		}
+		if de.smallFormat {
+			// The whole element was already read into tagbuf by
+			// nextElement, so the trailer can be verified right away.
+			if err := verifyTrailer(seq); err != nil {
+				return dataElement{}, err
+			}
+		} else {
+			de.r = &verifyingReader{ReaderAt: de.r, seq: seq, end: int64(de.nBytes)}
+		}
+		return de, nil
+	}
+
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return dataElement{}, err
+	}
+	zstream := elementStream{bo, bytes.NewReader(data), 0, false}
+	return zstream.nextElement()
+}
+
+// sequentialReaderAt adapts a forward-only io.Reader, such as a zlib
+// decompression stream, to the io.ReaderAt interface elementStream
+// requires, without materializing the stream in memory. It only supports
+// reads starting at or after the farthest point read so far, which
+// matches the strictly sequential access pattern of
+// elementStream.nextElement and its callers.
+type sequentialReaderAt struct {
+	r   io.Reader
+	pos int64
+}
+
+func newSequentialReaderAt(r io.Reader) *sequentialReaderAt {
+	return &sequentialReaderAt{r: r}
+}
+
+func (s *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < s.pos {
+		return 0, errors.New("matfile: sequentialReaderAt: read at offset already passed")
+	}
+	if off > s.pos {
+		if _, err := io.CopyN(io.Discard, s.r, off-s.pos); err != nil {
+			return 0, err
+		}
+		s.pos = off
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close closes the underlying stream, if it is closeable.
+func (s *sequentialReaderAt) Close() error {
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// verifyTrailer reads one byte past the end of seq's logical stream,
+// forcing a decompressor like zlib's to observe end-of-stream and
+// validate its trailer checksum, then closes seq. Without this, a
+// streaming consumer that reads exactly the declared number of data
+// bytes and no further never drives the decompressor to notice a
+// truncated or corrupted compressed stream.
+func verifyTrailer(seq *sequentialReaderAt) error {
+	var tail [1]byte
+	_, err := seq.ReadAt(tail[:], seq.pos)
+	if err != nil && err != io.EOF {
+		seq.Close()
+		return err
+	}
+	return seq.Close()
+}
+
+// verifyingReader wraps a streamed dataElement's reader so that once
+// the caller has read through to the declared end of its data,
+// verifyTrailer runs automatically.
+type verifyingReader struct {
+	io.ReaderAt
+	seq  *sequentialReaderAt
+	end  int64
+	pos  int64 // high-water mark of bytes read through this reader
+	done bool
+}
+
+func (v *verifyingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := v.ReaderAt.ReadAt(p, off)
+	if off+int64(n) > v.pos {
+		v.pos = off + int64(n)
+	}
+	if !v.done && (err == nil || err == io.EOF) && v.pos >= v.end {
+		v.done = true
+		if verr := verifyTrailer(v.seq); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// finish forces verifyTrailer to run if it hasn't already. The Array
+// Flags, Dimensions, and per-subelement reads inside decodeArray only
+// read each subelement's declared data length, never its trailing pad
+// bytes up to the next 8-byte boundary; for the last subelement of a
+// miMATRIX those pad bytes are never otherwise read, so ReadAt's
+// v.pos >= v.end check never fires on its own. decodeElement calls
+// finish once the class-specific decode of the matrix has fully
+// completed: it first reads through any bytes (such as trailing
+// padding) skipped by the decode, via the same ReaderAt used throughout,
+// so the drain lands at the right absolute offset in the decompression
+// stream, then verifies the trailer.
+func (v *verifyingReader) finish() error {
+	if v.done {
+		return nil
+	}
+	if v.pos < v.end {
+		discard := make([]byte, v.end-v.pos)
+		if _, err := v.ReadAt(discard, v.pos); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if v.done {
+		return nil
+	}
+	v.done = true
+	return verifyTrailer(v.seq)
+}
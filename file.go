@@ -0,0 +1,193 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File represents a MAT-file that has been indexed for random access to
+// its variables. Modeled on debug/elf.File, NewFile performs a single
+// forward pass over the top-level data element stream, recording each
+// variable's metadata and file offset without decoding its class-specific
+// data. Lookup then decodes a single variable directly from its recorded
+// offset, so a tool that opens a file with hundreds of variables need
+// not decode the ones it doesn't use.
+//
+// File only indexes the v5 TLV format; a v7.3 (HDF5) MAT-file already
+// has its own indexed directory structure; NewFile reports an error for
+// one rather than reimplementing that lookup.
+type File struct {
+	Header
+	bo   binary.ByteOrder
+	r    io.ReaderAt
+	vars []*FileVar
+}
+
+// FileVar describes one top-level variable recorded in a File's index.
+type FileVar struct {
+	VarInfo
+
+	offset     int64 // file offset of the variable's data element tag
+	size       int64 // size in bytes of the data element, tag through padding
+	compressed bool  // whether the element is stored as miCOMPRESSED
+}
+
+// Open opens the named file read-only and indexes its variables.
+func Open(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(f)
+}
+
+// NewFile indexes the variables in r. It reads every variable's Array
+// Flags, Dimensions, and Name subelements, but not its class-specific
+// data, so the scan stays cheap even when some variables are large.
+//
+// NewFile only understands the v5 TLV format; see the File doc comment.
+func NewFile(r io.ReaderAt) (*File, error) {
+	vr, err := NewV5Reader(r)
+	if err != nil {
+		return nil, err
+	}
+	var probe [8]byte
+	n, _ := r.ReadAt(probe[:], 128)
+	if uint16(vr.Version) == 0x0200 || (n == len(probe) && probe == hdf5Magic) {
+		return nil, errors.New("matfile: NewFile cannot index a v7.3 (HDF5) MAT-file")
+	}
+	f := &File{Header: vr.Header, bo: vr.ByteOrder, r: r}
+	for {
+		offset := vr.pos
+		de, err := vr.nextElement()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		info, compressed, err := peekVarInfo(de, f.bo)
+		if err != nil {
+			return nil, err
+		}
+		f.vars = append(f.vars, &FileVar{
+			VarInfo:    info,
+			offset:     offset,
+			size:       vr.pos - offset,
+			compressed: compressed,
+		})
+	}
+	return f, nil
+}
+
+// peekVarInfo decodes only the Array Flags, Dimensions, and Name
+// subelements of a (possibly compressed) miMATRIX element, leaving its
+// class-specific data unread, and reports whether the element was
+// miCOMPRESSED on disk.
+func peekVarInfo(de dataElement, bo binary.ByteOrder) (VarInfo, bool, error) {
+	compressed := false
+	if de.dataType != miMATRIX {
+		if _, ok := compressorFor(de.dataType); !ok {
+			return VarInfo{}, false, errors.New("matfile: expected a matrix element")
+		}
+		compressed = true
+		zde, err := decompressElement(de, bo, true)
+		if err != nil {
+			return VarInfo{}, false, err
+		}
+		de = zde
+	}
+
+	sub := elementStream{bo, de.r, 0, true}
+	flags, err := decodeArrayFlags(&sub, bo)
+	if err != nil {
+		return VarInfo{}, compressed, err
+	}
+	dims, err := decodeDimensions(&sub, bo)
+	if err != nil {
+		return VarInfo{}, compressed, err
+	}
+	name, err := decodeName(&sub, bo)
+	if err != nil {
+		return VarInfo{}, compressed, err
+	}
+
+	return VarInfo{
+		IsComplex:  flags.isComplex,
+		IsGlobal:   flags.isGlobal,
+		IsLogical:  flags.isLogical,
+		ArrayClass: flags.class,
+		Dimensions: dims,
+		Name:       name,
+		Nzmax:      flags.nzmax,
+	}, compressed, nil
+}
+
+// Close closes the underlying reader, if it is closeable, such as the
+// *os.File opened by Open.
+func (f *File) Close() error {
+	if c, ok := f.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Variables returns the metadata of every top-level variable in f, in
+// file order.
+func (f *File) Variables() []VarInfo {
+	infos := make([]VarInfo, len(f.vars))
+	for i, fv := range f.vars {
+		infos[i] = fv.VarInfo
+	}
+	return infos
+}
+
+// Lookup decodes and returns the named variable, starting from its
+// recorded offset rather than rescanning the file from the header.
+func (f *File) Lookup(name string) (*Var, error) {
+	fv := f.find(name)
+	if fv == nil {
+		return nil, fmt.Errorf("matfile: no variable named %q", name)
+	}
+	es := elementStream{f.bo, f.r, fv.offset, false}
+	de, err := es.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeElement(de, f.bo, false)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := raw.(*Var)
+	if !ok {
+		return nil, errors.New("matfile: indexed element is not a matrix")
+	}
+	return v, nil
+}
+
+// Section returns a SectionReader over the named variable's raw data
+// element as stored on disk: miCOMPRESSED bytes if the variable was
+// written compressed, the encoded miMATRIX element otherwise.
+func (f *File) Section(name string) (*io.SectionReader, error) {
+	fv := f.find(name)
+	if fv == nil {
+		return nil, fmt.Errorf("matfile: no variable named %q", name)
+	}
+	return io.NewSectionReader(f.r, fv.offset, fv.size), nil
+}
+
+func (f *File) find(name string) *FileVar {
+	for _, fv := range f.vars {
+		if fv.Name == name {
+			return fv
+		}
+	}
+	return nil
+}
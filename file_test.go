@@ -0,0 +1,138 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// multiVarMatFile encodes a MAT-file containing several variables, the
+// last one compressed, for exercising File's index.
+func multiVarMatFile(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	for i, name := range []string{"a", "b"} {
+		v := Var{
+			VarInfo: VarInfo{
+				ArrayClass: ClassDouble,
+				Dimensions: []int32{1, 1},
+				Name:       name,
+			},
+			RealPart: []float64{float64(i)},
+		}
+		if err := w.Write(v); err != nil {
+			t.Fatalf("Write(%q): %v", name, err)
+		}
+	}
+
+	w.CompressLevel = 6
+	v := Var{
+		VarInfo: VarInfo{
+			ArrayClass: ClassDouble,
+			Dimensions: []int32{1, 3},
+			Name:       "c",
+		},
+		RealPart: []float64{1, 2, 3},
+	}
+	if err := w.Write(v); err != nil {
+		t.Fatalf("Write(%q): %v", "c", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNewFileVariables(t *testing.T) {
+	f, err := NewFile(bytes.NewReader(multiVarMatFile(t)))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+
+	infos := f.Variables()
+	if len(infos) != 3 {
+		t.Fatalf("got %d variables, want 3", len(infos))
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	want := []string{"a", "b", "c"}
+	for i, name := range want {
+		if names[i] != name {
+			t.Errorf("Variables()[%d].Name = %q, want %q", i, names[i], name)
+		}
+	}
+}
+
+func TestFileLookup(t *testing.T) {
+	f, err := NewFile(bytes.NewReader(multiVarMatFile(t)))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+
+	v, err := f.Lookup("c")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	got, ok := v.RealPart.([]float64)
+	if !ok {
+		t.Fatalf("RealPart is %T, want []float64", v.RealPart)
+	}
+	want := []float64{1, 2, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("RealPart[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := f.Lookup("nope"); err == nil {
+		t.Errorf("Lookup(%q): got nil error, want not found", "nope")
+	}
+}
+
+// TestOpenClose confirms Close releases the *os.File opened by Open, so
+// a caller of Open has a way to release it.
+func TestOpenClose(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "vars.mat")
+	if err := os.WriteFile(name, multiVarMatFile(t), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := Open(name)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestFileSection(t *testing.T) {
+	f, err := NewFile(bytes.NewReader(multiVarMatFile(t)))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+
+	sr, err := f.Section("a")
+	if err != nil {
+		t.Fatalf("Section: %v", err)
+	}
+	var tagbuf [8]byte
+	if _, err := sr.ReadAt(tagbuf[:], 0); err != nil {
+		t.Fatalf("reading section: %v", err)
+	}
+	tg := decodeTag(tagbuf[:], f.bo)
+	if tg.dataType != miMATRIX {
+		t.Errorf("section tag dataType = %v, want miMATRIX", tg.dataType)
+	}
+
+	if _, err := f.Section("nope"); err == nil {
+		t.Errorf("Section(%q): got nil error, want not found", "nope")
+	}
+}
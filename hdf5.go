@@ -0,0 +1,407 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+//go:build hdf5
+
+package matfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf16"
+
+	"gonum.org/v1/hdf5"
+)
+
+// refsGroupName is the HDF5 group MATLAB uses to hold the targets of
+// object references used by cell and struct arrays.
+const refsGroupName = "#refs#"
+
+// hdf5Reader implements VarReader for the v7.3 MAT-file format: an HDF5
+// file whose root group holds one dataset or group per top-level
+// variable, alongside a "#refs#" group of reference targets.
+type hdf5Reader struct {
+	file  *hdf5.File
+	root  *hdf5.Group
+	names []string
+	pos   int
+
+	// tmpPath holds the path of a temporary file created to give the
+	// cgo HDF5 library a filesystem path to open, when r did not
+	// already have one; empty otherwise.
+	tmpPath string
+}
+
+var _ VarReader = (*hdf5Reader)(nil)
+
+// newHDF5Reader opens the v7.3 HDF5 image in r and prepares to decode
+// its top-level variables in the order they appear in the root group,
+// skipping the internal "#refs#" group used for cell/struct references.
+func newHDF5Reader(r io.ReaderAt) (VarReader, error) {
+	path, tmpPath, err := hdf5Path(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := hdf5.OpenFile(path, hdf5.F_ACC_RDONLY)
+	if err != nil {
+		removeTemp(tmpPath)
+		return nil, err
+	}
+	root, err := f.OpenGroup("/")
+	if err != nil {
+		f.Close()
+		removeTemp(tmpPath)
+		return nil, err
+	}
+
+	n, err := root.NumObjects()
+	if err != nil {
+		root.Close()
+		f.Close()
+		removeTemp(tmpPath)
+		return nil, err
+	}
+	var names []string
+	for i := uint(0); i < n; i++ {
+		name, err := root.ObjectNameByIndex(i)
+		if err != nil {
+			root.Close()
+			f.Close()
+			removeTemp(tmpPath)
+			return nil, err
+		}
+		if name == refsGroupName {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return &hdf5Reader{file: f, root: root, names: names, tmpPath: tmpPath}, nil
+}
+
+// hdf5Path returns a filesystem path to r's data, which the cgo-based
+// HDF5 library requires in place of an io.ReaderAt. If r is already
+// backed by a named file, that path is reused directly; otherwise r's
+// contents are copied into a temporary file, whose path is returned as
+// tmpPath so the caller can remove it once the hdf5.File is closed.
+func hdf5Path(r io.ReaderAt) (path, tmpPath string, err error) {
+	if named, ok := r.(interface{ Name() string }); ok {
+		return named.Name(), "", nil
+	}
+
+	tmp, err := os.CreateTemp("", "matfile-*.mat")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+
+	var buf [32 * 1024]byte
+	var off int64
+	for {
+		n, err := r.ReadAt(buf[:], off)
+		if n > 0 {
+			if _, werr := tmp.Write(buf[:n]); werr != nil {
+				os.Remove(tmp.Name())
+				return "", "", werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", "", err
+		}
+	}
+	return tmp.Name(), tmp.Name(), nil
+}
+
+func removeTemp(tmpPath string) {
+	if tmpPath != "" {
+		os.Remove(tmpPath)
+	}
+}
+
+// Next decodes and returns the next top-level Var, or io.EOF once every
+// variable in the root group has been returned.
+func (hr *hdf5Reader) Next() (*Var, error) {
+	if hr.pos >= len(hr.names) {
+		return nil, io.EOF
+	}
+	name := hr.names[hr.pos]
+	hr.pos++
+	return decodeHDF5Var(hr.root, name)
+}
+
+// hdf5ClassNames maps the MATLAB_class attribute string MATLAB writes
+// into a v7.3 file to the matching ArrayClass.
+var hdf5ClassNames = map[string]ArrayClass{
+	"cell":    ClassCell,
+	"struct":  ClassStruct,
+	"char":    ClassChar,
+	"sparse":  ClassSparse,
+	"double":  ClassDouble,
+	"single":  ClassSingle,
+	"logical": ClassDouble, // decoded as numeric; IsLogical distinguishes it
+	"int8":    ClassInt8,
+	"uint8":   ClassUint8,
+	"int16":   ClassInt16,
+	"uint16":  ClassUint16,
+	"int32":   ClassInt32,
+	"uint32":  ClassUint32,
+	"int64":   ClassInt64,
+	"uint64":  ClassUint64,
+}
+
+// decodeHDF5Var decodes the object named name within group as a Var,
+// translating its MATLAB_class attribute into the matching ArrayClass.
+//
+// Decoding a cell or struct array requires resolving HDF5 object
+// references stored in the file's "#refs#" group; gonum.org/v1/hdf5
+// exposes no API for reading or resolving object references, so those
+// two classes are reported as unsupported rather than decoded
+// incorrectly.
+func decodeHDF5Var(group *hdf5.Group, name string) (*Var, error) {
+	isGroup, classStr, err := hdf5ObjectClass(group, name)
+	if err != nil {
+		return nil, err
+	}
+	class, ok := hdf5ClassNames[classStr]
+	if !ok {
+		return nil, fmt.Errorf("matfile: unrecognized MATLAB_class %q for %q", classStr, name)
+	}
+
+	if isGroup {
+		switch class {
+		case ClassSparse:
+			v := &Var{VarInfo: VarInfo{ArrayClass: class, Name: name}}
+			if err := decodeHDF5Sparse(group, name, v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		case ClassCell, ClassStruct:
+			return nil, fmt.Errorf("matfile: %q is a %s array, which the hdf5 backend cannot decode: gonum.org/v1/hdf5 has no API for resolving the object references stored in %s", name, classStr, refsGroupName)
+		default:
+			return nil, fmt.Errorf("matfile: %q is a group but MATLAB_class is %q", name, classStr)
+		}
+	}
+
+	ds, err := group.OpenDataset(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+
+	dims, err := hdf5Dims(ds)
+	if err != nil {
+		return nil, err
+	}
+	v := &Var{VarInfo: VarInfo{ArrayClass: class, Dimensions: dims, Name: name}}
+	switch class {
+	case ClassChar:
+		err = decodeHDF5Char(ds, v)
+	default:
+		err = decodeHDF5Numeric(ds, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// hdf5ObjectClass reports whether name is a group within group, and
+// reads its MATLAB_class attribute either way.
+func hdf5ObjectClass(group *hdf5.Group, name string) (isGroup bool, class string, err error) {
+	if g, gerr := group.OpenGroup(name); gerr == nil {
+		defer g.Close()
+		attr, err := g.OpenAttribute("MATLAB_class")
+		if err != nil {
+			return true, "", err
+		}
+		defer attr.Close()
+		class, err := readStringAttr(attr)
+		return true, class, err
+	}
+
+	ds, err := group.OpenDataset(name)
+	if err != nil {
+		return false, "", err
+	}
+	defer ds.Close()
+	attr, err := ds.OpenAttribute("MATLAB_class")
+	if err != nil {
+		return false, "", err
+	}
+	defer attr.Close()
+	class, err = readStringAttr(attr)
+	return false, class, err
+}
+
+// hdf5Dims reads a dataset's dataspace extent and reverses it: HDF5
+// stores dimensions in row-major (C) order, while MATLAB's Dimensions
+// are column-major (Fortran) order.
+func hdf5Dims(ds *hdf5.Dataset) ([]int32, error) {
+	extent, _, err := ds.Space().SimpleExtentDims()
+	if err != nil {
+		return nil, err
+	}
+	dims := make([]int32, len(extent))
+	for i, d := range extent {
+		dims[len(extent)-1-i] = int32(d)
+	}
+	return dims, nil
+}
+
+// decodeHDF5Numeric reads a numeric, logical, or complex dataset's real
+// and, if present, imaginary parts.
+func decodeHDF5Numeric(ds *hdf5.Dataset, v *Var) error {
+	if isLogical, err := readOptionalInt32Attr(ds, "MATLAB_int_decode"); err != nil {
+		return err
+	} else if isLogical != 0 {
+		v.IsLogical = true
+	}
+
+	realPart, imagPart, err := readNumericDataset(ds)
+	if err != nil {
+		return err
+	}
+	v.RealPart = realPart
+	if imagPart != nil {
+		v.IsComplex = true
+		v.ImagPart = imagPart
+	}
+	return nil
+}
+
+// decodeHDF5Char reads a char dataset's data and converts it to a
+// string, mirroring decodeChar's handling of the v5 format.
+func decodeHDF5Char(ds *hdf5.Dataset, v *Var) error {
+	var codes []uint16
+	if err := ds.Read(&codes); err != nil {
+		return err
+	}
+	v.RealPart = string(utf16.Decode(codes))
+	return nil
+}
+
+// decodeHDF5Sparse reads the data, ir, and jc datasets of a sparse
+// array, stored as a group in the v7.3 format.
+func decodeHDF5Sparse(group *hdf5.Group, name string, v *Var) error {
+	g, err := group.OpenGroup(name)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	ir, err := readInt32Dataset(g, "ir")
+	if err != nil {
+		return err
+	}
+	jc, err := readInt32Dataset(g, "jc")
+	if err != nil {
+		return err
+	}
+	v.RowIndex = ir
+	v.ColIndex = jc
+
+	ds, err := g.OpenDataset("data")
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	realPart, imagPart, err := readNumericDataset(ds)
+	if err != nil {
+		return err
+	}
+	v.RealPart = realPart
+	if imagPart != nil {
+		v.IsComplex = true
+		v.ImagPart = imagPart
+	}
+	return nil
+}
+
+// readNumericDataset reads a numeric dataset's data, returning a
+// non-nil imagPart only if the dataset's HDF5 datatype is the compound
+// {real, imag} type MATLAB uses for complex arrays. gonum.org/v1/hdf5
+// reads a compound dataset by copying its on-disk bytes directly into
+// the destination's memory, with no field-by-field conversion, so this
+// relies on realImag's in-memory layout matching the file's compound
+// layout exactly.
+func readNumericDataset(ds *hdf5.Dataset) (realPart, imagPart interface{}, err error) {
+	dtype, err := ds.Datatype()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dtype.Close()
+
+	if dtype.Class() == hdf5.T_COMPOUND {
+		var parts []realImag
+		if err := ds.Read(&parts); err != nil {
+			return nil, nil, err
+		}
+		real := make([]float64, len(parts))
+		imag := make([]float64, len(parts))
+		for i, p := range parts {
+			real[i] = p.Real
+			imag[i] = p.Imag
+		}
+		return real, imag, nil
+	}
+
+	var data []float64
+	if err := ds.Read(&data); err != nil {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
+
+// realImag mirrors the {real, imag} compound datatype MATLAB writes
+// for complex arrays in the v7.3 format.
+type realImag struct {
+	Real, Imag float64
+}
+
+func readInt32Dataset(group *hdf5.Group, name string) ([]int32, error) {
+	ds, err := group.OpenDataset(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	var data []int32
+	if err := ds.Read(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readStringAttr reads attr as a scalar string. A nil *Datatype is safe
+// here: Attribute.Read special-cases string destinations by fetching
+// the attribute's own datatype itself.
+func readStringAttr(attr *hdf5.Attribute) (string, error) {
+	var s string
+	if err := attr.Read(&s, nil); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// readOptionalInt32Attr reads name as a scalar int32 attribute of ds,
+// returning 0 if the attribute does not exist; MATLAB_int_decode is
+// only present on datasets that need it.
+func readOptionalInt32Attr(ds *hdf5.Dataset, name string) (int32, error) {
+	attr, err := ds.OpenAttribute(name)
+	if err != nil {
+		return 0, nil
+	}
+	defer attr.Close()
+	var n int32
+	if err := attr.Read(&n, hdf5.T_NATIVE_INT32); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+//go:build !hdf5
+
+package matfile
+
+import (
+	"errors"
+	"io"
+)
+
+// newHDF5Reader is overridden by hdf5.go when matfile is built with the
+// "hdf5" build tag. Without that tag, a v7.3 MAT-file is still detected
+// by NewReader, but there is no backend available to decode it.
+func newHDF5Reader(r io.ReaderAt) (VarReader, error) {
+	return nil, errors.New("matfile: this binary was built without HDF5 support; rebuild with -tags hdf5 to read v7.3 MAT-files")
+}
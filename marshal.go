@@ -0,0 +1,572 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Marshal maps a Go value onto a named Var, using reflection in the
+// manner of encoding/gob: numeric scalars, slices and 2-D slices map to
+// the matching numeric ArrayClass (column-major, as MATLAB stores
+// matrices); complex64/complex128 map to a complex array; string maps to
+// ClassChar; []interface{} maps to ClassCell; and map[string]interface{}
+// or a Go struct (using `mat:"name"` tags to rename fields) maps to
+// ClassStruct.
+func Marshal(name string, v interface{}) (Var, error) {
+	mv, err := marshalValue(reflect.ValueOf(v))
+	if err != nil {
+		return Var{}, err
+	}
+	mv.Name = name
+	return *mv, nil
+}
+
+func marshalValue(rv reflect.Value) (*Var, error) {
+	switch rv.Kind() {
+	case reflect.Interface:
+		return marshalValue(rv.Elem())
+	case reflect.String:
+		return marshalString(rv), nil
+	case reflect.Map, reflect.Struct:
+		return marshalStruct(rv)
+	case reflect.Slice, reflect.Array:
+		return marshalArray(rv)
+	default:
+		if isNumericKind(rv.Kind()) {
+			return marshalScalar(rv), nil
+		}
+	}
+	return nil, fmt.Errorf("matfile: cannot marshal %s", rv.Type())
+}
+
+func marshalString(rv reflect.Value) *Var {
+	v := &Var{}
+	v.ArrayClass = ClassChar
+	v.Dimensions = []int32{1, int32(rv.Len())}
+	v.RealPart = rv.String()
+	return v
+}
+
+func marshalScalar(rv reflect.Value) *Var {
+	kind := rv.Kind()
+	realPart, imagPart, isComplex := collectNumeric(kind, 1, func(int) reflect.Value { return rv })
+	v := &Var{}
+	v.ArrayClass, _ = classForKind(kind)
+	v.Dimensions = []int32{1, 1}
+	v.IsComplex = isComplex
+	v.RealPart = realPart
+	v.ImagPart = imagPart
+	return v
+}
+
+// marshalArray handles []interface{} (cell arrays), [][]T (2-D numeric
+// matrices, column-major) and []T (numeric column vectors).
+func marshalArray(rv reflect.Value) (*Var, error) {
+	elem := rv.Type().Elem()
+	switch {
+	case elem.Kind() == reflect.Interface:
+		return marshalCell(rv)
+	case elem.Kind() == reflect.Slice && isNumericKind(elem.Elem().Kind()):
+		return marshalMatrix(rv)
+	case isNumericKind(elem.Kind()):
+		return marshalVector(rv), nil
+	}
+	return nil, fmt.Errorf("matfile: cannot marshal %s", rv.Type())
+}
+
+func marshalVector(rv reflect.Value) *Var {
+	n := rv.Len()
+	kind := rv.Type().Elem().Kind()
+	realPart, imagPart, isComplex := collectNumeric(kind, n, rv.Index)
+	v := &Var{}
+	v.ArrayClass, _ = classForKind(kind)
+	v.Dimensions = []int32{int32(n), 1}
+	v.IsComplex = isComplex
+	v.RealPart = realPart
+	v.ImagPart = imagPart
+	return v
+}
+
+func marshalMatrix(rv reflect.Value) (*Var, error) {
+	rows := rv.Len()
+	var cols int
+	if rows > 0 {
+		cols = rv.Index(0).Len()
+	}
+	for r := 1; r < rows; r++ {
+		if rv.Index(r).Len() != cols {
+			return nil, errors.New("matfile: cannot marshal a ragged slice as a matrix")
+		}
+	}
+	kind := rv.Type().Elem().Elem().Kind()
+	at := func(i int) reflect.Value {
+		return rv.Index(i % rows).Index(i / rows)
+	}
+	realPart, imagPart, isComplex := collectNumeric(kind, rows*cols, at)
+	v := &Var{}
+	v.ArrayClass, _ = classForKind(kind)
+	v.Dimensions = []int32{int32(rows), int32(cols)}
+	v.IsComplex = isComplex
+	v.RealPart = realPart
+	v.ImagPart = imagPart
+	return v, nil
+}
+
+func marshalCell(rv reflect.Value) (*Var, error) {
+	n := rv.Len()
+	cells := make([]*Var, n)
+	for i := 0; i < n; i++ {
+		cv, err := marshalValue(rv.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		cells[i] = cv
+	}
+	v := &Var{}
+	v.ArrayClass = ClassCell
+	v.Dimensions = []int32{int32(n), 1}
+	v.Cells = cells
+	return v, nil
+}
+
+// marshalStruct handles map[string]interface{} and Go structs, storing
+// each as a 1x1 ClassStruct array.
+func marshalStruct(rv reflect.Value) (*Var, error) {
+	names, values, err := structFields(rv)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldNameLength := 1
+	for _, name := range names {
+		if len(name)+1 > fieldNameLength {
+			fieldNameLength = len(name) + 1
+		}
+	}
+	fieldNames := make([]int8, 0, len(names)*fieldNameLength)
+	for _, name := range names {
+		b := make([]byte, fieldNameLength)
+		copy(b, name)
+		for _, c := range b {
+			fieldNames = append(fieldNames, int8(c))
+		}
+	}
+
+	cells := make([]*Var, len(values))
+	for i, fv := range values {
+		cv, err := marshalValue(fv)
+		if err != nil {
+			return nil, err
+		}
+		cells[i] = cv
+	}
+
+	v := &Var{}
+	v.ArrayClass = ClassStruct
+	v.Dimensions = []int32{1, 1}
+	v.FieldNameLength = int32(fieldNameLength)
+	v.FieldNames = fieldNames
+	v.Cells = cells
+	return v, nil
+}
+
+// structFields returns the field names and values of a
+// map[string]interface{} (sorted for determinism) or a Go struct, where
+// a `mat:"name"` tag overrides the Go field name and unexported fields
+// are skipped.
+func structFields(rv reflect.Value) ([]string, []reflect.Value, error) {
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, nil, fmt.Errorf("matfile: cannot marshal map with %s keys", rv.Type().Key())
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		names := make([]string, len(keys))
+		values := make([]reflect.Value, len(keys))
+		for i, k := range keys {
+			names[i] = k.String()
+			values[i] = rv.MapIndex(k)
+		}
+		return names, values, nil
+	case reflect.Struct:
+		t := rv.Type()
+		var names []string
+		var values []reflect.Value
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("mat"); tag != "" {
+				name = tag
+			}
+			names = append(names, name)
+			values = append(values, rv.Field(i))
+		}
+		return names, values, nil
+	}
+	return nil, nil, fmt.Errorf("matfile: cannot marshal %s as a struct", rv.Type())
+}
+
+// Unmarshal decodes v into dst, which must be a non-nil pointer. For a
+// destination of the Go type Marshal started from, it is the inverse of
+// Marshal; values decoded into []interface{} or map[string]interface{}
+// take the generic forms cellToInterface describes, so a numeric scalar
+// there comes back as a one-element slice.
+func Unmarshal(v Var, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("matfile: Unmarshal requires a non-nil pointer")
+	}
+	return unmarshalValue(v, rv.Elem())
+}
+
+func unmarshalValue(v Var, dst reflect.Value) error {
+	switch v.ArrayClass {
+	case ClassChar:
+		s, ok := v.RealPart.(string)
+		if !ok || dst.Kind() != reflect.String {
+			return fmt.Errorf("matfile: cannot unmarshal a char array into %s", dst.Type())
+		}
+		dst.SetString(s)
+		return nil
+	case ClassCell:
+		return unmarshalCell(v, dst)
+	case ClassStruct, ClassObject:
+		return unmarshalStruct(v, dst)
+	default:
+		return unmarshalNumeric(v, dst)
+	}
+}
+
+func unmarshalNumeric(v Var, dst reflect.Value) error {
+	n, err := numElements(v.Dimensions)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dst.Kind() != reflect.Slice && n == 1:
+		return setScalar(dst, v, 0)
+	case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() != reflect.Slice:
+		dst.Set(reflect.MakeSlice(dst.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := setScalar(dst.Index(i), v, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Slice:
+		if len(v.Dimensions) != 2 {
+			return fmt.Errorf("matfile: cannot unmarshal a %d-D array into %s", len(v.Dimensions), dst.Type())
+		}
+		rows, cols := int(v.Dimensions[0]), int(v.Dimensions[1])
+		if rows < 0 || cols < 0 {
+			return errors.New("matfile: negative dimension in Dimensions Array")
+		}
+		out := reflect.MakeSlice(dst.Type(), rows, rows)
+		for r := 0; r < rows; r++ {
+			row := reflect.MakeSlice(dst.Type().Elem(), cols, cols)
+			for c := 0; c < cols; c++ {
+				if err := setScalar(row.Index(c), v, r+c*rows); err != nil {
+					return err
+				}
+			}
+			out.Index(r).Set(row)
+		}
+		dst.Set(out)
+		return nil
+	}
+	return fmt.Errorf("matfile: cannot unmarshal numeric data into %s", dst.Type())
+}
+
+// setScalar sets dst to the i'th element of v's real (and, if complex,
+// imaginary) part.
+func setScalar(dst reflect.Value, v Var, i int) error {
+	realSlice := reflect.ValueOf(v.RealPart)
+	if realSlice.Kind() != reflect.Slice || i >= realSlice.Len() {
+		return fmt.Errorf("matfile: real part index %d out of range", i)
+	}
+
+	if v.IsComplex {
+		if dst.Kind() != reflect.Complex64 && dst.Kind() != reflect.Complex128 {
+			return fmt.Errorf("matfile: cannot unmarshal complex data into %s", dst.Type())
+		}
+		imagSlice := reflect.ValueOf(v.ImagPart)
+		dst.SetComplex(complex(asFloat64(realSlice.Index(i)), asFloat64(imagSlice.Index(i))))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(asFloat64(realSlice.Index(i)))
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		dst.SetInt(asInt64(realSlice.Index(i)))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		dst.SetUint(asUint64(realSlice.Index(i)))
+	default:
+		return fmt.Errorf("matfile: cannot unmarshal numeric data into %s", dst.Type())
+	}
+	return nil
+}
+
+func unmarshalCell(v Var, dst reflect.Value) error {
+	if dst.Kind() != reflect.Slice || dst.Type().Elem().Kind() != reflect.Interface {
+		return fmt.Errorf("matfile: cannot unmarshal a cell array into %s", dst.Type())
+	}
+	out := reflect.MakeSlice(dst.Type(), len(v.Cells), len(v.Cells))
+	for i, cell := range v.Cells {
+		val, err := cellToInterface(cell)
+		if err != nil {
+			return err
+		}
+		out.Index(i).Set(reflect.ValueOf(val))
+	}
+	dst.Set(out)
+	return nil
+}
+
+func unmarshalStruct(v Var, dst reflect.Value) error {
+	n, err := numElements(v.Dimensions)
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return errors.New("matfile: only scalar struct arrays can be unmarshaled")
+	}
+	names := fieldNamesOf(v)
+
+	switch dst.Kind() {
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String || dst.Type().Elem().Kind() != reflect.Interface {
+			return fmt.Errorf("matfile: cannot unmarshal a struct array into %s", dst.Type())
+		}
+		m := reflect.MakeMap(dst.Type())
+		for i, name := range names {
+			val, err := cellToInterface(v.Cells[i])
+			if err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(name), reflect.ValueOf(val))
+		}
+		dst.Set(m)
+		return nil
+	case reflect.Struct:
+		t := dst.Type()
+		for i, name := range names {
+			for f := 0; f < t.NumField(); f++ {
+				field := t.Field(f)
+				fieldName := field.Name
+				if tag := field.Tag.Get("mat"); tag != "" {
+					fieldName = tag
+				}
+				if fieldName == name {
+					if err := unmarshalValue(*v.Cells[i], dst.Field(f)); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("matfile: cannot unmarshal a struct array into %s", dst.Type())
+}
+
+// cellToInterface decodes v into a generic Go value: a concrete numeric
+// slice for numeric classes, string for ClassChar, []interface{} for
+// ClassCell, and map[string]interface{} for ClassStruct/ClassObject.
+func cellToInterface(v *Var) (interface{}, error) {
+	switch v.ArrayClass {
+	case ClassChar:
+		return v.RealPart, nil
+	case ClassCell:
+		out := make([]interface{}, len(v.Cells))
+		for i, c := range v.Cells {
+			e, err := cellToInterface(c)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = e
+		}
+		return out, nil
+	case ClassStruct, ClassObject:
+		n, err := numElements(v.Dimensions)
+		if err != nil {
+			return nil, err
+		}
+		if n != 1 {
+			return nil, errors.New("matfile: only scalar struct arrays can be unmarshaled")
+		}
+		names := fieldNamesOf(*v)
+		m := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			e, err := cellToInterface(v.Cells[i])
+			if err != nil {
+				return nil, err
+			}
+			m[name] = e
+		}
+		return m, nil
+	default:
+		return v.RealPart, nil
+	}
+}
+
+// fieldNamesOf splits v.FieldNames into the individual, NUL-trimmed
+// field names of a struct or object array.
+func fieldNamesOf(v Var) []string {
+	width := int(v.FieldNameLength)
+	if width == 0 {
+		return nil
+	}
+	n := len(v.FieldNames) / width
+	names := make([]string, n)
+	for i := 0; i < n; i++ {
+		raw := v.FieldNames[i*width : (i+1)*width]
+		b := make([]byte, 0, width)
+		for _, c := range raw {
+			if c == 0 {
+				break
+			}
+			b = append(b, byte(c))
+		}
+		names[i] = string(b)
+	}
+	return names
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	_, ok := classForKind(k)
+	return ok
+}
+
+// classForKind maps a Go numeric reflect.Kind onto the ArrayClass Marshal
+// stores it as.
+func classForKind(k reflect.Kind) (ArrayClass, bool) {
+	switch k {
+	case reflect.Float64, reflect.Complex128:
+		return ClassDouble, true
+	case reflect.Float32, reflect.Complex64:
+		return ClassSingle, true
+	case reflect.Int8:
+		return ClassInt8, true
+	case reflect.Uint8:
+		return ClassUint8, true
+	case reflect.Int16:
+		return ClassInt16, true
+	case reflect.Uint16:
+		return ClassUint16, true
+	case reflect.Int32:
+		return ClassInt32, true
+	case reflect.Uint32:
+		return ClassUint32, true
+	case reflect.Int64:
+		return ClassInt64, true
+	case reflect.Uint64:
+		return ClassUint64, true
+	}
+	return 0, false
+}
+
+// collectNumeric reads n values of the given kind through at, returning
+// concrete Go slices (e.g. []float64) suitable for Var.RealPart and
+// Var.ImagPart.
+func collectNumeric(kind reflect.Kind, n int, at func(i int) reflect.Value) (realPart interface{}, imagPart interface{}, isComplex bool) {
+	switch kind {
+	case reflect.Float64:
+		out := make([]float64, n)
+		for i := range out {
+			out[i] = at(i).Float()
+		}
+		return out, nil, false
+	case reflect.Float32:
+		out := make([]float32, n)
+		for i := range out {
+			out[i] = float32(at(i).Float())
+		}
+		return out, nil, false
+	case reflect.Int8:
+		out := make([]int8, n)
+		for i := range out {
+			out[i] = int8(at(i).Int())
+		}
+		return out, nil, false
+	case reflect.Uint8:
+		out := make([]uint8, n)
+		for i := range out {
+			out[i] = uint8(at(i).Uint())
+		}
+		return out, nil, false
+	case reflect.Int16:
+		out := make([]int16, n)
+		for i := range out {
+			out[i] = int16(at(i).Int())
+		}
+		return out, nil, false
+	case reflect.Uint16:
+		out := make([]uint16, n)
+		for i := range out {
+			out[i] = uint16(at(i).Uint())
+		}
+		return out, nil, false
+	case reflect.Int32:
+		out := make([]int32, n)
+		for i := range out {
+			out[i] = int32(at(i).Int())
+		}
+		return out, nil, false
+	case reflect.Uint32:
+		out := make([]uint32, n)
+		for i := range out {
+			out[i] = uint32(at(i).Uint())
+		}
+		return out, nil, false
+	case reflect.Int64:
+		out := make([]int64, n)
+		for i := range out {
+			out[i] = at(i).Int()
+		}
+		return out, nil, false
+	case reflect.Uint64:
+		out := make([]uint64, n)
+		for i := range out {
+			out[i] = at(i).Uint()
+		}
+		return out, nil, false
+	case reflect.Complex128:
+		re := make([]float64, n)
+		im := make([]float64, n)
+		for i := range re {
+			c := at(i).Complex()
+			re[i], im[i] = real(c), imag(c)
+		}
+		return re, im, true
+	case reflect.Complex64:
+		re := make([]float32, n)
+		im := make([]float32, n)
+		for i := range re {
+			c := at(i).Complex()
+			re[i], im[i] = float32(real(c)), float32(imag(c))
+		}
+		return re, im, true
+	}
+	return nil, nil, false
+}
+
+var (
+	float64Type = reflect.TypeOf(float64(0))
+	int64Type   = reflect.TypeOf(int64(0))
+	uint64Type  = reflect.TypeOf(uint64(0))
+)
+
+func asFloat64(rv reflect.Value) float64 { return rv.Convert(float64Type).Float() }
+func asInt64(rv reflect.Value) int64     { return rv.Convert(int64Type).Int() }
+func asUint64(rv reflect.Value) uint64   { return rv.Convert(uint64Type).Uint() }
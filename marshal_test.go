@@ -0,0 +1,171 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalScalar(t *testing.T) {
+	v, err := Marshal("x", 3.5)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if v.ArrayClass != ClassDouble {
+		t.Errorf("ArrayClass = %v, want %v", v.ArrayClass, ClassDouble)
+	}
+	var got float64
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != 3.5 {
+		t.Errorf("got %v, want 3.5", got)
+	}
+}
+
+func TestMarshalVector(t *testing.T) {
+	want := []float64{1, 2, 3}
+	v, err := Marshal("x", want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got []float64
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMarshalMatrix(t *testing.T) {
+	want := [][]float64{{1, 2, 3}, {4, 5, 6}}
+	v, err := Marshal("x", want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if len(v.Dimensions) != 2 || v.Dimensions[0] != 2 || v.Dimensions[1] != 3 {
+		t.Fatalf("Dimensions = %v, want [2 3]", v.Dimensions)
+	}
+	var got [][]float64
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMarshalComplex(t *testing.T) {
+	want := complex(1.5, -2.5)
+	v, err := Marshal("x", want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !v.IsComplex {
+		t.Fatalf("IsComplex = false, want true")
+	}
+	var got complex128
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMarshalString(t *testing.T) {
+	v, err := Marshal("x", "hello")
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got string
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestMarshalCell(t *testing.T) {
+	want := []interface{}{1.0, "a"}
+	v, err := Marshal("x", want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got []interface{}
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d cells, want 2", len(got))
+	}
+	if s, ok := got[1].(string); !ok || s != "a" {
+		t.Errorf("got[1] = %v, want %q", got[1], "a")
+	}
+}
+
+func TestMarshalStruct(t *testing.T) {
+	type point struct {
+		X float64
+		Y float64 `mat:"y"`
+	}
+	want := point{X: 1, Y: 2}
+	v, err := Marshal("p", want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if v.ArrayClass != ClassStruct {
+		t.Fatalf("ArrayClass = %v, want %v", v.ArrayClass, ClassStruct)
+	}
+
+	var got point
+	if err := Unmarshal(v, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var m map[string]interface{}
+	if err := Unmarshal(v, &m); err != nil {
+		t.Fatalf("Unmarshal into map: %v", err)
+	}
+	if _, ok := m["y"]; !ok {
+		t.Errorf("map missing renamed field %q: %v", "y", m)
+	}
+}
+
+// TestMarshalRoundTripThroughWriter confirms a Marshaled Var survives a
+// full encode/decode cycle through Writer and ReadAll.
+func TestMarshalRoundTripThroughWriter(t *testing.T) {
+	v, err := Marshal("a", []float64{1, 2, 3})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.Write(v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	vars, err := ReadAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	var got []float64
+	if err := Unmarshal(*vars[0], &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := []float64{1, 2, 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -2,23 +2,43 @@
 // This is program is free software.  You may distribute it under the
 // terms of the GNU General Public License.
 
-// Package matfile implements the encoding and decoding of v5 MAT-File data.
+// Package matfile implements the encoding and decoding of MAT-File data,
+// both the v5 TLV format and, when built with the "hdf5" build tag, the
+// HDF5-based v7.3 format.
 package matfile
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math"
 	"unicode/utf16"
 )
 
-// VarReader represents a file: a single header followed by
-// a sequence of decodable data elements
-type VarReader struct {
+// VarReader decodes a sequence of top-level Vars from a MAT-file.
+// NewReader returns a V5Reader or, for v7.3 files, an HDF5-backed
+// implementation; callers need not know which.
+type VarReader interface {
+	// Next decodes and returns the next top-level Var, or io.EOF once
+	// the stream of variables is exhausted.
+	Next() (*Var, error)
+}
+
+// V5Reader implements VarReader for the v5 TLV MAT-file format: a
+// single header followed by a sequence of decodable data elements. It
+// is exported, rather than reached only through the VarReader
+// interface, so that callers who know they have a v5 file can still
+// read its Header and set Streaming; NewReader returns it as a
+// VarReader, so use NewV5Reader directly or a type assertion on
+// NewReader's result to reach either.
+type V5Reader struct {
 	Header
 	elementStream
 }
 
+var _ VarReader = (*V5Reader)(nil)
+
 // Header contains descriptive text, a version, and a byte-order indicator
 type Header struct {
 	Description     [116]byte // descriptive text
@@ -33,6 +53,123 @@ type elementStream struct {
 	binary.ByteOrder
 	r   io.ReaderAt
 	pos int64
+
+	// Streaming, when set on the embedding VarReader, asks
+	// decompressElement to decode a miCOMPRESSED element's contents
+	// directly off the decompression stream instead of buffering the
+	// whole thing into memory first. This avoids OOMing on MAT files
+	// with multi-GB compressed arrays, at the cost of requiring
+	// subelements to be read in order.
+	Streaming bool
+}
+
+// hdf5Magic is the 8-byte HDF5 superblock signature. In a v7.3 MAT-file
+// it follows immediately after the usual 128-byte text header.
+var hdf5Magic = [8]byte{0x89, 'H', 'D', 'F', '\r', '\n', 0x1a, '\n'}
+
+// NewReader detects whether r holds a v5 or v7.3 MAT-file and returns a
+// VarReader for the format: a V5Reader positioned after the 128-byte
+// header, or an HDF5-backed reader built on the root group of the HDF5
+// image that starts at byte 128.
+func NewReader(r io.ReaderAt) (VarReader, error) {
+	var probe [136]byte
+	n, err := r.ReadAt(probe[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n >= 128 {
+		var endian [2]byte
+		copy(endian[:], probe[126:128])
+		bo := byteOrderFor(endian)
+		version := bo.Uint16(probe[124:126])
+		isV73 := version == 0x0200
+		if n >= 136 && bytes.Equal(probe[128:136], hdf5Magic[:]) {
+			isV73 = true
+		}
+		if isV73 {
+			return newHDF5Reader(r)
+		}
+	}
+	return NewV5Reader(r)
+}
+
+// byteOrderFor returns the binary.ByteOrder indicated by a header's
+// 2-byte endian indicator, defaulting to little-endian if it is not
+// recognized; callers that need to reject an unrecognized indicator
+// check it separately.
+func byteOrderFor(endian [2]byte) binary.ByteOrder {
+	if endian == ([2]byte{'M', 'I'}) {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// NewV5Reader reads the 128-byte header from r, determines the byte
+// order from the endian indicator, and returns a V5Reader positioned at
+// the first data element.
+func NewV5Reader(r io.ReaderAt) (*V5Reader, error) {
+	var buf [128]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
+		return nil, err
+	}
+
+	var endian [2]byte
+	copy(endian[:], buf[126:128])
+	switch endian {
+	case [2]byte{'M', 'I'}, [2]byte{'I', 'M'}:
+	default:
+		return nil, errors.New("matfile: unrecognized endian indicator")
+	}
+	bo := byteOrderFor(endian)
+
+	var h Header
+	copy(h.Description[:], buf[:116])
+	h.Offset = int64(bo.Uint64(buf[116:124]))
+	h.Version = int16(bo.Uint16(buf[124:126]))
+	h.EndianIndicator = endian
+
+	return &V5Reader{
+		Header:        h,
+		elementStream: elementStream{bo, r, 128, false},
+	}, nil
+}
+
+// Next decodes and returns the next top-level Var, or io.EOF once the
+// stream of data elements is exhausted.
+func (vr *V5Reader) Next() (*Var, error) {
+	de, err := vr.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeElement(de, vr.ByteOrder, vr.Streaming)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := raw.(*Var)
+	if !ok {
+		return nil, errors.New("matfile: top-level element is not a matrix")
+	}
+	return v, nil
+}
+
+// ReadAll reads every Var from r in sequence.
+func ReadAll(r io.ReaderAt) ([]*Var, error) {
+	vr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var vars []*Var
+	for {
+		v, err := vr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, v)
+	}
+	return vars, nil
 }
 
 type tag struct {
@@ -66,7 +203,11 @@ func (er *elementStream) nextElement() (dataElement, error) {
 	}
 	de.tag = decodeTag(tagbuf[:], er.ByteOrder)
 	if de.smallFormat == true {
-		de.r = io.NewSectionReader(er.r, er.pos+4, int64(de.nBytes))
+		// The small-format data is packed into the same 8-byte block as
+		// the tag, already present in tagbuf; read it from there instead
+		// of issuing an overlapping ReadAt on er.r, which a streaming,
+		// sequential-only reader could not satisfy.
+		de.r = bytes.NewReader(tagbuf[4 : 4+de.nBytes])
 		er.pos = er.pos + 8
 	} else {
 		de.r = io.NewSectionReader(er.r, er.pos+8, int64(de.nBytes))
@@ -82,30 +223,39 @@ func (er *elementStream) nextElement() (dataElement, error) {
 
 // TODO consider returning error if data length is not divisible the right way
 
-func decodeElement(de dataElement, bo binary.ByteOrder) (interface{}, error) {
+func decodeElement(de dataElement, bo binary.ByteOrder, streaming bool) (interface{}, error) {
 	switch de.dataType {
 	case miINT8, miUINT8, miINT16, miUINT16, miINT32, miUINT32,
 		miINT64, miUINT64, miSINGLE, miDOUBLE,
 		miUTF8, miUTF16, miUTF32:
 		return decodeNumeric(de, bo)
 	case miMATRIX:
-		return decodeArray(de, bo)
-	case miCOMPRESSED:
-		zde, err := decompressElement(de, bo)
-		if err != nil {
-			return nil, err
+		return decodeArray(de, bo, streaming)
+	default:
+		if _, ok := compressorFor(de.dataType); ok {
+			zde, err := decompressElement(de, bo, streaming)
+			if err != nil {
+				return nil, err
+			}
+			result, err := decodeElement(zde, bo, streaming)
+			if err != nil {
+				return nil, err
+			}
+			// The class-specific decode above only reads each
+			// subelement's declared data, never the pad bytes after an
+			// unaligned final subelement, so force the trailer check
+			// now rather than rely on a read that may never happen.
+			if vr, ok := zde.r.(*verifyingReader); ok {
+				if err := vr.finish(); err != nil {
+					return nil, err
+				}
+			}
+			return result, nil
 		}
-		return decodeElement(zde, bo)
 	}
 	return nil, nil
 }
 
-// decodeArray decodes structured array data
-func decodeArray(de dataElement, bo binary.ByteOrder) (interface{}, error) {
-	panic("decode Array not implemented")
-	return nil, nil
-}
-
 // decodeNumeric decodes a simple stream of numeric or character data
 func decodeNumeric(de dataElement, bo binary.ByteOrder) (interface{}, error) {
 	var b [8]byte
@@ -132,57 +282,57 @@ func decodeNumeric(de dataElement, bo binary.ByteOrder) (interface{}, error) {
 		return val, nil
 	case miINT16:
 		val := make([]int16, de.nBytes/2)
-		for i := range bs {
+		for i := range val {
 			val[i] = int16(bo.Uint16(bs[2*i:]))
 		}
 		return val, nil
 	case miUINT16:
 		val := make([]uint16, de.nBytes/2)
-		for i := range bs {
+		for i := range val {
 			val[i] = bo.Uint16(bs[2*i:])
 		}
-				return val, nil
+		return val, nil
 	case miINT32:
 		val := make([]int32, de.nBytes/4)
-		for i := range bs {
+		for i := range val {
 			val[i] = int32(bo.Uint32(bs[4*i:]))
 		}
-				return val, nil
+		return val, nil
 	case miUINT32:
 		val := make([]uint32, de.nBytes/4)
-		for i := range bs {
+		for i := range val {
 			val[i] = bo.Uint32(bs[4*i:])
 		}
-				return val, nil
+		return val, nil
 	case miINT64:
 		val := make([]int64, de.nBytes/8)
-		for i := range bs {
+		for i := range val {
 			val[i] = int64(bo.Uint64(bs[8*i:]))
 		}
-				return val, nil
+		return val, nil
 	case miUINT64:
 		val := make([]uint64, de.nBytes/8)
-		for i := range bs {
+		for i := range val {
 			val[i] = bo.Uint64(bs[8*i:])
 		}
-				return val, nil
+		return val, nil
 	case miSINGLE:
 		val := make([]float32, de.nBytes/4)
-		for i := range bs {
+		for i := range val {
 			val[i] = math.Float32frombits(bo.Uint32(bs[4*i:]))
 		}
-				return val, nil
+		return val, nil
 	case miDOUBLE:
 		val := make([]float64, de.nBytes/8)
-		for i := range bs {
+		for i := range val {
 			val[i] = math.Float64frombits(bo.Uint64(bs[8*i:]))
 		}
-				return val, nil
+		return val, nil
 	case miUTF8:
 		return string(bs), nil
 	case miUTF16:
 		x := make([]uint16, de.nBytes/2)
-		for i := range bs {
+		for i := range x {
 			x[i] = bo.Uint16(bs[2*i:])
 		}
 		return string(utf16.Decode(x)), nil
@@ -196,28 +346,9 @@ func decodeNumeric(de dataElement, bo binary.ByteOrder) (interface{}, error) {
 	return nil, nil
 }
 
-// TODO decompressElement cannot handle a doubly-compressed element,
-// because the zlibReaderAt does not implement io.Reader.
-// Figure out if the MAT-file specification permits 2x-compressed elts.
-
-// TODO also figure out whether miCOMPRESSED must contain only
-// a single element, or if it can contain a stream of elements.
-
-func decompressElement(in dataElement, bo binary.ByteOrder) (dataElement, error) {
-	rd := in.r.(io.Reader)
-	zrat, err := newzlibReaderAt(rd, int(in.nBytes))
-	if err != nil {
-		return dataElement{}, err
-	}
-	defer zrat.(io.Closer).Close()
-	
-	zstream := elementStream{bo, zrat, 0}
-	return zstream.nextElement()
-}
-
 // VarWriter encodes variables sequentially
 type VarWriter interface {
-	Write(Var)
+	Write(Var) error
 }
 
 // Var is the basic unit of data decoded from a File
@@ -4,35 +4,499 @@
 
 package matfile
 
-import "testing"
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+)
 
 // To test *decoding*, we read data from a file of known content
 // created by GNU Octave.
 
 // To test *encoding*, we encode data, then decode it and check consistency.
 
-// TestHeader is a placeholder for tests of more specific functionality
+// TestHeader confirms NewV5Reader parses the 128-byte header's endian
+// indicator and version.
 func TestHeader(t *testing.T) {
-	t.Errorf("Header not implemented")
+	vr, err := NewV5Reader(bytes.NewReader(rawDoubleMatFile(t)))
+	if err != nil {
+		t.Fatalf("NewV5Reader: %v", err)
+	}
+	if vr.Version != 0x0100 {
+		t.Errorf("Version = %#x, want 0x0100", vr.Version)
+	}
+	if vr.EndianIndicator != ([2]byte{'M', 'I'}) {
+		t.Errorf("EndianIndicator = %v, want MI", vr.EndianIndicator)
+	}
 }
 
-// TestGetVarInfo is a placeholder for tests of more specific functionality
+// TestGetVarInfo confirms ReadAll populates VarInfo's class, dimension,
+// and name fields correctly for a decoded variable.
 func TestGetVarInfo(t *testing.T) {
-	t.Errorf("GetVarInfo not implemented")
+	got, err := ReadAll(bytes.NewReader(rawDoubleMatFile(t)))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d vars, want 1", len(got))
+	}
+	info := got[0].VarInfo
+	if info.ArrayClass != ClassDouble {
+		t.Errorf("ArrayClass = %v, want ClassDouble", info.ArrayClass)
+	}
+	if info.Name != "a" {
+		t.Errorf("Name = %q, want %q", info.Name, "a")
+	}
+	wantDims := []int32{1, 3}
+	if len(info.Dimensions) != len(wantDims) {
+		t.Fatalf("Dimensions = %v, want %v", info.Dimensions, wantDims)
+	}
+	for i, d := range wantDims {
+		if info.Dimensions[i] != d {
+			t.Errorf("Dimensions[%d] = %v, want %v", i, info.Dimensions[i], d)
+		}
+	}
 }
 
-// TestGetVar is a placeholder for tests of more specific functionality
+// rawDoubleMatFile builds a minimal, hand-encoded v5 MAT-file (big-endian)
+// containing a single double-precision row vector named "a" with values
+// 1, 2, 3.
+func rawDoubleMatFile(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+
+	var header [128]byte
+	copy(header[124:126], []byte{0x01, 0x00})
+	copy(header[126:128], []byte("MI"))
+	buf.Write(header[:])
+
+	var flags bytes.Buffer
+	writeTag(&flags, miUINT32, 8)
+	writeUint32(&flags, uint32(ClassDouble))
+	writeUint32(&flags, 0) // nzmax
+
+	var dims bytes.Buffer
+	writeTag(&dims, miINT32, 8)
+	writeInt32(&dims, 1)
+	writeInt32(&dims, 3)
+
+	var name bytes.Buffer
+	writeSmallTag(&name, miINT8, 1)
+	name.WriteByte('a')
+	name.Write(make([]byte, 3)) // pad to the 8-byte boundary
+
+	var pr bytes.Buffer
+	writeTag(&pr, miDOUBLE, 24)
+	writeFloat64(&pr, 1)
+	writeFloat64(&pr, 2)
+	writeFloat64(&pr, 3)
+
+	var body bytes.Buffer
+	body.Write(flags.Bytes())
+	body.Write(dims.Bytes())
+	body.Write(name.Bytes())
+	body.Write(pr.Bytes())
+
+	writeTag(&buf, miMATRIX, uint32(body.Len()))
+	buf.Write(body.Bytes())
+
+	return buf.Bytes()
+}
+
+func writeTag(buf *bytes.Buffer, dt dataType, nBytes uint32) {
+	writeUint32(buf, uint32(dt))
+	writeUint32(buf, nBytes)
+}
+
+func writeSmallTag(buf *bytes.Buffer, dt dataType, nBytes uint16) {
+	writeUint32(buf, uint32(dt)|uint32(nBytes)<<16)
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeInt32(buf *bytes.Buffer, v int32) {
+	writeUint32(buf, uint32(v))
+}
+
+func writeFloat64(buf *bytes.Buffer, v float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	buf.Write(b[:])
+}
+
+// TestGetVar decodes a hand-built numeric array and checks its contents.
 func TestGetVar(t *testing.T) {
-	t.Errorf("GetVar not implemented")
+	r := bytes.NewReader(rawDoubleMatFile(t))
+	vars, err := ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(vars) != 1 {
+		t.Fatalf("got %d vars, want 1", len(vars))
+	}
+	v := vars[0]
+	if v.Name != "a" {
+		t.Errorf("Name = %q, want %q", v.Name, "a")
+	}
+	if v.ArrayClass != ClassDouble {
+		t.Errorf("ArrayClass = %v, want %v", v.ArrayClass, ClassDouble)
+	}
+	want := []float64{1, 2, 3}
+	got, ok := v.RealPart.([]float64)
+	if !ok {
+		t.Fatalf("RealPart is %T, want []float64", v.RealPart)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("RealPart[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
 }
 
-// TestNext is a placeholder for tests of more specific functionality
+// TestNext exercises VarReader.Next directly, including the io.EOF
+// returned once the stream is exhausted.
 func TestNext(t *testing.T) {
-	t.Errorf("Next not implemented")
+	r := bytes.NewReader(rawDoubleMatFile(t))
+	vr, err := NewReader(r)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if _, err := vr.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if _, err := vr.Next(); err != io.EOF {
+		t.Errorf("second Next: got %v, want io.EOF", err)
+	}
 }
 
-// TestPutVar is a placeholder for tests of more specific functionality
+// TestPutVar round-trips a Var through a Writer and back through a
+// VarReader, and checks that the decoded Var matches the original.
 func TestPutVar(t *testing.T) {
-	t.Errorf("PutVar not implemented")
+	v := Var{
+		VarInfo: VarInfo{
+			ArrayClass: ClassDouble,
+			Dimensions: []int32{1, 3},
+			Name:       "a",
+		},
+		RealPart: []float64{1, 2, 3},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.Write(v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := ReadAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d vars, want 1", len(got))
+	}
+	if got[0].Name != v.Name {
+		t.Errorf("Name = %q, want %q", got[0].Name, v.Name)
+	}
+	want := v.RealPart.([]float64)
+	gotReal, ok := got[0].RealPart.([]float64)
+	if !ok {
+		t.Fatalf("RealPart is %T, want []float64", got[0].RealPart)
+	}
+	for i := range want {
+		if gotReal[i] != want[i] {
+			t.Errorf("RealPart[%d] = %v, want %v", i, gotReal[i], want[i])
+		}
+	}
+}
+
+// TestPutVarCompressed round-trips a Var through a compressed Writer and
+// back through ReadAll, exercising the default (buffered) decompression
+// path.
+func TestPutVarCompressed(t *testing.T) {
+	v := Var{
+		VarInfo: VarInfo{
+			ArrayClass: ClassDouble,
+			Dimensions: []int32{1, 3},
+			Name:       "a",
+		},
+		RealPart: []float64{1, 2, 3},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.CompressLevel = 6
+	if err := w.Write(v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	data := buf.Bytes()[128:]
+	outerTag := decodeTag(data[:8], binary.LittleEndian)
+	if outerTag.dataType != miCOMPRESSED {
+		t.Fatalf("outer element type = %v, want miCOMPRESSED", outerTag.dataType)
+	}
+
+	got, err := ReadAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d vars, want 1", len(got))
+	}
+	if got[0].Name != v.Name {
+		t.Errorf("Name = %q, want %q", got[0].Name, v.Name)
+	}
+	want := v.RealPart.([]float64)
+	gotReal, ok := got[0].RealPart.([]float64)
+	if !ok {
+		t.Fatalf("RealPart is %T, want []float64", got[0].RealPart)
+	}
+	for i := range want {
+		if gotReal[i] != want[i] {
+			t.Errorf("RealPart[%d] = %v, want %v", i, gotReal[i], want[i])
+		}
+	}
+}
+
+// TestPutVarCompressedStreaming repeats TestPutVarCompressed with
+// Streaming set on the underlying V5Reader, which decodes the
+// miCOMPRESSED element's contents directly off the zlib stream instead
+// of buffering it.
+func TestPutVarCompressedStreaming(t *testing.T) {
+	v := Var{
+		VarInfo: VarInfo{
+			ArrayClass: ClassDouble,
+			Dimensions: []int32{1, 3},
+			Name:       "a",
+		},
+		RealPart: []float64{1, 2, 3},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.CompressLevel = 6
+	if err := w.Write(v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	vr, err := NewV5Reader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewV5Reader: %v", err)
+	}
+	vr.Streaming = true
+
+	got, err := vr.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	want := v.RealPart.([]float64)
+	gotReal, ok := got.RealPart.([]float64)
+	if !ok {
+		t.Fatalf("RealPart is %T, want []float64", got.RealPart)
+	}
+	for i := range want {
+		if gotReal[i] != want[i] {
+			t.Errorf("RealPart[%d] = %v, want %v", i, gotReal[i], want[i])
+		}
+	}
 }
 
+// TestDecompressElementNested confirms a miCOMPRESSED element nested
+// inside another miCOMPRESSED element decodes correctly, now that
+// decompressElement operates on an io.Reader view of the enclosing
+// section instead of a type assertion on in.r.
+func TestDecompressElementNested(t *testing.T) {
+	inner := rawDoubleMatFile(t)[128:] // strip the 128-byte header, keep the raw miMATRIX element
+
+	innerCompressed := zlibCompress(t, inner)
+
+	var middle bytes.Buffer
+	writeTag(&middle, miCOMPRESSED, uint32(len(innerCompressed)))
+	middle.Write(innerCompressed)
+
+	outerCompressed := zlibCompress(t, middle.Bytes())
+
+	de := dataElement{
+		tag: tag{dataType: miCOMPRESSED, nBytes: uint32(len(outerCompressed))},
+		r:   bytes.NewReader(outerCompressed),
+	}
+	raw, err := decodeElement(de, binary.BigEndian, false)
+	if err != nil {
+		t.Fatalf("decodeElement: %v", err)
+	}
+	v, ok := raw.(*Var)
+	if !ok {
+		t.Fatalf("decodeElement returned %T, want *Var", raw)
+	}
+	if v.Name != "a" {
+		t.Errorf("Name = %q, want %q", v.Name, "a")
+	}
+}
+
+// TestDecompressElementNestedStreaming confirms a miCOMPRESSED element
+// nested inside another miCOMPRESSED element decodes correctly when
+// streaming is enabled, so the sequentialReaderAt/verifyingReader
+// chaining across the two nested decompression layers cascades
+// correctly all the way to the innermost data.
+func TestDecompressElementNestedStreaming(t *testing.T) {
+	inner := rawDoubleMatFile(t)[128:] // strip the 128-byte header, keep the raw miMATRIX element
+
+	innerCompressed := zlibCompress(t, inner)
+
+	var middle bytes.Buffer
+	writeTag(&middle, miCOMPRESSED, uint32(len(innerCompressed)))
+	middle.Write(innerCompressed)
+
+	outerCompressed := zlibCompress(t, middle.Bytes())
+
+	de := dataElement{
+		tag: tag{dataType: miCOMPRESSED, nBytes: uint32(len(outerCompressed))},
+		r:   bytes.NewReader(outerCompressed),
+	}
+	raw, err := decodeElement(de, binary.BigEndian, true)
+	if err != nil {
+		t.Fatalf("decodeElement: %v", err)
+	}
+	v, ok := raw.(*Var)
+	if !ok {
+		t.Fatalf("decodeElement returned %T, want *Var", raw)
+	}
+	if v.Name != "a" {
+		t.Errorf("Name = %q, want %q", v.Name, "a")
+	}
+	want := []float64{1, 2, 3}
+	got, ok := v.RealPart.([]float64)
+	if !ok {
+		t.Fatalf("RealPart is %T, want []float64", v.RealPart)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("RealPart[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestDecompressElementStreamingDetectsTruncation confirms the
+// streaming decode path surfaces a truncated compressed stream as an
+// error once its data is actually read, rather than silently
+// succeeding because nothing forced the zlib reader to observe its
+// own end-of-stream and check its trailer checksum.
+func TestDecompressElementStreamingDetectsTruncation(t *testing.T) {
+	raw := rawDoubleMatFile(t)[128:] // strip the 128-byte header, keep the raw miMATRIX element
+	compressed := zlibCompress(t, raw)
+	truncated := compressed[:len(compressed)-1]
+
+	de := dataElement{
+		tag: tag{dataType: miCOMPRESSED, nBytes: uint32(len(truncated))},
+		r:   bytes.NewReader(truncated),
+	}
+	zde, err := decompressElement(de, binary.BigEndian, true)
+	if err != nil {
+		// A short enough truncation can fail while decoding the tag
+		// itself, before any lazy verification comes into play.
+		return
+	}
+	buf := make([]byte, zde.nBytes)
+	if _, err := zde.r.ReadAt(buf, 0); err == nil {
+		t.Fatal("ReadAt of a truncated compressed stream succeeded, want an error")
+	}
+}
+
+// TestPutVarCompressedStreamingDetectsCorruptionAfterOddLength confirms
+// the streaming decode path verifies the zlib trailer even when the
+// matrix's last subelement isn't 8-byte aligned on its own (here, a
+// 10-byte char array), so the trailing pad bytes are never read as part
+// of decoding the subelement itself and the check has to be forced once
+// the class-specific decode finishes.
+func TestPutVarCompressedStreamingDetectsCorruptionAfterOddLength(t *testing.T) {
+	v := Var{
+		VarInfo: VarInfo{
+			ArrayClass: ClassChar,
+			Dimensions: []int32{1, 10},
+			Name:       "s",
+		},
+		RealPart: "abcdefghij",
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.CompressLevel = 6
+	if err := w.Write(v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	corrupted := buf.Bytes()
+	corrupted[len(corrupted)-1] ^= 0xff // flip every bit of the zlib trailer's last byte
+
+	vr, err := NewV5Reader(bytes.NewReader(corrupted))
+	if err != nil {
+		t.Fatalf("NewV5Reader: %v", err)
+	}
+	vr.Streaming = true
+
+	if _, err := vr.Next(); err == nil {
+		t.Fatal("Next with a corrupted zlib trailer succeeded, want an error")
+	}
+}
+
+// TestGetVarRejectsNegativeDimensions confirms that a cell array whose
+// Dimensions subelement contains a negative value is reported as a
+// decode error, rather than panicking when the element count is used to
+// size the Cells slice.
+func TestGetVarRejectsNegativeDimensions(t *testing.T) {
+	var flags bytes.Buffer
+	writeTag(&flags, miUINT32, 8)
+	writeUint32(&flags, uint32(ClassCell))
+	writeUint32(&flags, 0) // nzmax
+
+	var dims bytes.Buffer
+	writeTag(&dims, miINT32, 8)
+	writeInt32(&dims, -1)
+	writeInt32(&dims, 1)
+
+	var name bytes.Buffer
+	writeSmallTag(&name, miINT8, 1)
+	name.WriteByte('c')
+	name.Write(make([]byte, 3)) // pad to the 8-byte boundary
+
+	var body bytes.Buffer
+	body.Write(flags.Bytes())
+	body.Write(dims.Bytes())
+	body.Write(name.Bytes())
+
+	var buf bytes.Buffer
+	writeTag(&buf, miMATRIX, uint32(body.Len()))
+	buf.Write(body.Bytes())
+
+	var header [128]byte
+	copy(header[124:126], []byte{0x01, 0x00})
+	copy(header[126:128], []byte("MI"))
+
+	var file bytes.Buffer
+	file.Write(header[:])
+	file.Write(buf.Bytes())
+
+	if _, err := ReadAll(bytes.NewReader(file.Bytes())); err == nil {
+		t.Fatal("ReadAll with a negative Dimensions value succeeded, want a decode error")
+	}
+}
+
+// zlibCompress returns the zlib-compressed form of data.
+func zlibCompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("zlib write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zlib close: %v", err)
+	}
+	return buf.Bytes()
+}
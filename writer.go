@@ -0,0 +1,349 @@
+// Copyright 2015 Michael Spitznagel.
+// This is program is free software.  You may distribute it under the
+// terms of the GNU General Public License.
+
+package matfile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Writer encodes a sequence of Vars as a v5 MAT-file.
+type Writer struct {
+	w io.Writer
+
+	// Description is written into the 116-byte descriptive text field
+	// of the header; it is truncated, or zero-padded, to fit.
+	Description string
+
+	// CompressLevel selects the zlib compression level applied to each
+	// Var as it is written. The zero value (zlib.NoCompression) writes
+	// Vars uncompressed.
+	CompressLevel int
+
+	headerWritten bool
+}
+
+var _ VarWriter = (*Writer)(nil)
+
+// NewWriter returns a Writer that encodes to w. The header is written
+// lazily, on the first call to Write, so Description and CompressLevel
+// may still be set afterwards.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write encodes v as a single miMATRIX data element, compressing it
+// first if CompressLevel is set.
+func (wr *Writer) Write(v Var) error {
+	if !wr.headerWritten {
+		if err := wr.writeHeader(); err != nil {
+			return err
+		}
+		wr.headerWritten = true
+	}
+
+	var matrix bytes.Buffer
+	if err := encodeVarElement(&matrix, &v, binary.LittleEndian); err != nil {
+		return err
+	}
+
+	if wr.CompressLevel == zlib.NoCompression {
+		_, err := wr.w.Write(matrix.Bytes())
+		return err
+	}
+	return wr.writeCompressed(matrix.Bytes())
+}
+
+// writeCompressed wraps data in a miCOMPRESSED element.
+func (wr *Writer) writeCompressed(data []byte) error {
+	var compressed bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&compressed, wr.CompressLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	encodeTag(&out, miCOMPRESSED, uint32(compressed.Len()), binary.LittleEndian)
+	out.Write(compressed.Bytes())
+	_, err = wr.w.Write(out.Bytes())
+	return err
+}
+
+// writeHeader emits the 128-byte v5 header: Description, a zero
+// subsystem-data offset, version 0x0100, and a little-endian indicator.
+func (wr *Writer) writeHeader() error {
+	var buf [128]byte
+	copy(buf[:116], []byte(wr.Description))
+	binary.LittleEndian.PutUint16(buf[124:126], 0x0100)
+	copy(buf[126:128], []byte("IM"))
+	_, err := wr.w.Write(buf[:])
+	return err
+}
+
+// encodeTag writes an 8-byte normal-form tag.
+func encodeTag(buf *bytes.Buffer, dt dataType, nBytes uint32, bo binary.ByteOrder) {
+	putUint32(buf, uint32(dt), bo)
+	putUint32(buf, nBytes, bo)
+}
+
+// encodeSmallTag writes a 4-byte small-form tag; the data (padded to 4
+// bytes) follows immediately.
+func encodeSmallTag(buf *bytes.Buffer, dt dataType, nBytes int, bo binary.ByteOrder) {
+	putUint32(buf, uint32(dt)|uint32(nBytes)<<16, bo)
+}
+
+func putUint32(buf *bytes.Buffer, v uint32, bo binary.ByteOrder) {
+	var b [4]byte
+	bo.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func padTo8(buf *bytes.Buffer, n int) {
+	pad := (8 - (n & 7)) & 7
+	for i := 0; i < pad; i++ {
+		buf.WriteByte(0)
+	}
+}
+
+// writeElement writes raw as a subelement of type dt, using the small
+// form when it fits in 4 bytes and padding the normal form to an 8-byte
+// boundary.
+func writeElement(buf *bytes.Buffer, dt dataType, raw []byte, bo binary.ByteOrder) {
+	if len(raw) <= 4 {
+		encodeSmallTag(buf, dt, len(raw), bo)
+		buf.Write(raw)
+		for i := len(raw); i < 4; i++ {
+			buf.WriteByte(0)
+		}
+		return
+	}
+	encodeTag(buf, dt, uint32(len(raw)), bo)
+	buf.Write(raw)
+	padTo8(buf, len(raw))
+}
+
+// encodeVarElement encodes v as a complete miMATRIX data element
+// (tag plus subelements), suitable both as a top-level element and as
+// the recursive Var subelement of a cell, struct, or object array.
+func encodeVarElement(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	var body bytes.Buffer
+	if err := encodeMatrixBody(&body, v, bo); err != nil {
+		return err
+	}
+	encodeTag(buf, miMATRIX, uint32(body.Len()), bo)
+	buf.Write(body.Bytes())
+	return nil
+}
+
+// encodeMatrixBody encodes the Array Flags, Dimensions Array and Array
+// Name subelements common to every class, followed by the class-specific
+// subelements.
+func encodeMatrixBody(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	encodeArrayFlags(buf, v, bo)
+	encodeDimensions(buf, v.Dimensions, bo)
+	encodeName(buf, v.Name, bo)
+
+	switch v.ArrayClass {
+	case ClassCell:
+		return encodeCell(buf, v, bo)
+	case ClassStruct:
+		return encodeFields(buf, v, bo)
+	case ClassObject:
+		return encodeObject(buf, v, bo)
+	case ClassChar:
+		return encodeChar(buf, v, bo)
+	case ClassSparse:
+		return encodeSparse(buf, v, bo)
+	default:
+		return encodeNumericVar(buf, v, bo)
+	}
+}
+
+func encodeArrayFlags(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) {
+	var flagByte uint32
+	if v.IsComplex {
+		flagByte |= 0x08
+	}
+	if v.IsGlobal {
+		flagByte |= 0x04
+	}
+	if v.IsLogical {
+		flagByte |= 0x02
+	}
+	encodeTag(buf, miUINT32, 8, bo)
+	putUint32(buf, uint32(v.ArrayClass)|flagByte<<8, bo)
+	putUint32(buf, v.Nzmax, bo)
+}
+
+func encodeDimensions(buf *bytes.Buffer, dims []int32, bo binary.ByteOrder) {
+	raw := make([]byte, 4*len(dims))
+	for i, d := range dims {
+		bo.PutUint32(raw[4*i:], uint32(d))
+	}
+	writeElement(buf, miINT32, raw, bo)
+}
+
+func encodeName(buf *bytes.Buffer, name string, bo binary.ByteOrder) {
+	writeElement(buf, miINT8, []byte(name), bo)
+}
+
+// encodeNumeric writes data as a numeric subelement (pr or pi), choosing
+// the MAT data type that matches its Go type.
+func encodeNumeric(buf *bytes.Buffer, data interface{}, bo binary.ByteOrder) error {
+	var dt dataType
+	var raw []byte
+	switch vals := data.(type) {
+	case []int8:
+		dt = miINT8
+		raw = make([]byte, len(vals))
+		for i, x := range vals {
+			raw[i] = byte(x)
+		}
+	case []uint8:
+		dt = miUINT8
+		raw = append([]byte(nil), vals...)
+	case []int16:
+		dt = miINT16
+		raw = make([]byte, 2*len(vals))
+		for i, x := range vals {
+			bo.PutUint16(raw[2*i:], uint16(x))
+		}
+	case []uint16:
+		dt = miUINT16
+		raw = make([]byte, 2*len(vals))
+		for i, x := range vals {
+			bo.PutUint16(raw[2*i:], x)
+		}
+	case []int32:
+		dt = miINT32
+		raw = make([]byte, 4*len(vals))
+		for i, x := range vals {
+			bo.PutUint32(raw[4*i:], uint32(x))
+		}
+	case []uint32:
+		dt = miUINT32
+		raw = make([]byte, 4*len(vals))
+		for i, x := range vals {
+			bo.PutUint32(raw[4*i:], x)
+		}
+	case []int64:
+		dt = miINT64
+		raw = make([]byte, 8*len(vals))
+		for i, x := range vals {
+			bo.PutUint64(raw[8*i:], uint64(x))
+		}
+	case []uint64:
+		dt = miUINT64
+		raw = make([]byte, 8*len(vals))
+		for i, x := range vals {
+			bo.PutUint64(raw[8*i:], x)
+		}
+	case []float32:
+		dt = miSINGLE
+		raw = make([]byte, 4*len(vals))
+		for i, x := range vals {
+			bo.PutUint32(raw[4*i:], math.Float32bits(x))
+		}
+	case []float64:
+		dt = miDOUBLE
+		raw = make([]byte, 8*len(vals))
+		for i, x := range vals {
+			bo.PutUint64(raw[8*i:], math.Float64bits(x))
+		}
+	default:
+		return errors.New("matfile: unsupported numeric data type")
+	}
+	writeElement(buf, dt, raw, bo)
+	return nil
+}
+
+func encodeNumericVar(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	if err := encodeNumeric(buf, v.RealPart, bo); err != nil {
+		return err
+	}
+	if v.IsComplex {
+		if err := encodeNumeric(buf, v.ImagPart, bo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeSparse(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	rawIr := make([]byte, 4*len(v.RowIndex))
+	for i, x := range v.RowIndex {
+		bo.PutUint32(rawIr[4*i:], uint32(x))
+	}
+	writeElement(buf, miINT32, rawIr, bo)
+
+	rawJc := make([]byte, 4*len(v.ColIndex))
+	for i, x := range v.ColIndex {
+		bo.PutUint32(rawJc[4*i:], uint32(x))
+	}
+	writeElement(buf, miINT32, rawJc, bo)
+
+	return encodeNumericVar(buf, v, bo)
+}
+
+// encodeChar writes the character data subelement of a char array as
+// miUTF8, matching the string form decodeChar already understands.
+func encodeChar(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	s, ok := v.RealPart.(string)
+	if !ok {
+		return errors.New("matfile: char array RealPart must be a string")
+	}
+	writeElement(buf, miUTF8, []byte(s), bo)
+	return nil
+}
+
+func encodeCell(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	for _, cell := range v.Cells {
+		if err := encodeVarElement(buf, cell, bo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeFields writes the FieldNameLength, FieldNames, and per-field Var
+// subelements shared by struct and object arrays.
+func encodeFields(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	var lenRaw [4]byte
+	bo.PutUint32(lenRaw[:], uint32(v.FieldNameLength))
+	writeElement(buf, miINT32, lenRaw[:], bo)
+
+	names := make([]byte, len(v.FieldNames))
+	for i, c := range v.FieldNames {
+		names[i] = byte(c)
+	}
+	writeElement(buf, miINT8, names, bo)
+
+	for _, f := range v.Cells {
+		if err := encodeVarElement(buf, f, bo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeObject(buf *bytes.Buffer, v *Var, bo binary.ByteOrder) error {
+	className := make([]byte, len(v.ClassName))
+	for i, c := range v.ClassName {
+		className[i] = byte(c)
+	}
+	writeElement(buf, miINT8, className, bo)
+
+	return encodeFields(buf, v, bo)
+}